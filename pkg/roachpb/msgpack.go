@@ -0,0 +1,415 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package roachpb
+
+// github.com/vmihailenco/msgpack needs a dependency-manifest/vendoring
+// entry wherever this package is actually built; this checkout has no
+// go.mod or vendor directory for any package to begin with, so there is
+// nothing here to add that entry to. Wiring it in is the responsibility
+// of whichever build this code lands in.
+import (
+	"fmt"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// msgpackSchemaVersion is bumped whenever the frame format below changes
+// in a way that isn't forward compatible, so that peers negotiating
+// msgpack can reject a version they don't understand instead of
+// misinterpreting its bytes.
+const msgpackSchemaVersion = 1
+
+// MsgpackMarshaler is implemented by roachpb messages that support an
+// alternative MessagePack encoding alongside their generated protobuf
+// Marshal method. It's the msgpack counterpart to proto.Marshaler, used
+// to encode small point ops more cheaply than protobuf's varint/tag
+// framing.
+//
+// A per-connection negotiation flag (a BatchRequest.Header bit gRPC
+// peers would set to opt into this codec) isn't implemented here:
+// BatchRequest_Header is generated protobuf code with no .proto in this
+// checkout (same gap noted on StreamingScanResponse in
+// streaming_scan.go), so there's no generated field to add the flag to
+// without inventing a .proto this package doesn't have. Negotiating use
+// of this codec remains the caller's responsibility until that generated
+// code is available to extend.
+//
+// That means the codec round-trips correctly but no peer has a way to
+// actually select it yet -- the request this file was added for is not
+// fully closed. Landing the negotiation flag and wiring a peer to set it
+// is an open follow-up, blocked on the same generated code gap.
+type MsgpackMarshaler interface {
+	MarshalMsgpack() ([]byte, error)
+}
+
+// MsgpackUnmarshaler is the decode half of MsgpackMarshaler.
+type MsgpackUnmarshaler interface {
+	UnmarshalMsgpack([]byte) error
+}
+
+// msgpackFrame is the wire format written by MarshalMsgpack: a schema
+// version, the type tag identifying which concrete message Payload
+// holds, and the message's own msgpack-encoded bytes.
+type msgpackFrame struct {
+	Version int32
+	Tag     int32
+	Payload []byte
+}
+
+// requestMsgpackTags maps each Method to the stable integer tag used to
+// identify its request type on the msgpack wire. These tags are
+// persisted (they appear in msgpackFrame.Tag), so entries must never be
+// renumbered, only appended to.
+var requestMsgpackTags = map[Method]int32{
+	Get:                      1,
+	Put:                      2,
+	ConditionalPut:           3,
+	Increment:                4,
+	Delete:                   5,
+	DeleteRange:              6,
+	Scan:                     7,
+	ReverseScan:              8,
+	EndTransaction:           9,
+	DeprecatedVerifyChecksum: 10,
+}
+
+// DecodedRequest is the result of decoding a single msgpack-framed
+// request slot: either a concrete, recognized Request, or -- for a tag
+// this binary's registry doesn't recognize, e.g. one written by a newer
+// or older peer -- the still-encoded opaque payload. Unlike cramming an
+// unrecognized tag into RequestUnion, this doesn't require RequestUnion
+// to have a registered oneof member for it (RequestUnion.SetInner simply
+// returns false for anything it doesn't know about, and MustSetInner
+// panics on that false; DecodedRequest never calls either for the
+// unrecognized case), so an unknown request type round-trips through it
+// without panicking.
+type DecodedRequest struct {
+	// Request is set when the frame's tag was recognized.
+	Request Request
+	// RawTag and RawData are set instead when the tag wasn't recognized.
+	RawTag  int32
+	RawData []byte
+}
+
+// MarshalMsgpack implements MsgpackMarshaler, the inverse of
+// decodeRequestMsgpack: round-tripping an unrecognized tag reproduces the
+// same frame bytes rather than losing the tag.
+func (d DecodedRequest) MarshalMsgpack() ([]byte, error) {
+	if d.Request == nil {
+		return msgpack.Marshal(&msgpackFrame{Version: msgpackSchemaVersion, Tag: d.RawTag, Payload: d.RawData})
+	}
+	tag, ok := requestMsgpackTags[d.Request.Method()]
+	if !ok {
+		return nil, fmt.Errorf("no msgpack tag registered for method %s", d.Request.Method())
+	}
+	payload, err := msgpack.Marshal(d.Request)
+	if err != nil {
+		return nil, fmt.Errorf("msgpack: marshaling %T: %v", d.Request, err)
+	}
+	return msgpack.Marshal(&msgpackFrame{Version: msgpackSchemaVersion, Tag: tag, Payload: payload})
+}
+
+// decodeRequestMsgpack decodes a single msgpack-framed request slot,
+// resolving recognized tags to a concrete Request and leaving unrecognized
+// ones as opaque bytes rather than erroring or panicking.
+func decodeRequestMsgpack(data []byte) (DecodedRequest, error) {
+	var frame msgpackFrame
+	if err := msgpack.Unmarshal(data, &frame); err != nil {
+		return DecodedRequest{}, fmt.Errorf("msgpack: decoding frame: %v", err)
+	}
+	if frame.Version != msgpackSchemaVersion {
+		return DecodedRequest{}, fmt.Errorf("msgpack: unsupported schema version %d", frame.Version)
+	}
+	for method, tag := range requestMsgpackTags {
+		if tag != frame.Tag {
+			continue
+		}
+		req, err := newRequestForMethod(method)
+		if err != nil {
+			return DecodedRequest{}, err
+		}
+		if err := msgpack.Unmarshal(frame.Payload, req); err != nil {
+			return DecodedRequest{}, fmt.Errorf("msgpack: decoding %T: %v", req, err)
+		}
+		return DecodedRequest{Request: req}, nil
+	}
+	return DecodedRequest{RawTag: frame.Tag, RawData: frame.Payload}, nil
+}
+
+// MarshalMsgpack implements MsgpackMarshaler by framing the inner
+// request behind a schema version and stable type tag.
+func (ru RequestUnion) MarshalMsgpack() ([]byte, error) {
+	inner := ru.GetInner()
+	if inner == nil {
+		return nil, fmt.Errorf("cannot marshal empty RequestUnion to msgpack")
+	}
+	return DecodedRequest{Request: inner}.MarshalMsgpack()
+}
+
+// UnmarshalMsgpack implements MsgpackUnmarshaler. It errors on an
+// unrecognized tag rather than panicking: RequestUnion's SetInner only
+// accepts the fixed set of types its generated SetValue switch knows
+// about, so there is no registered member to hold an opaque payload in.
+// A caller that needs to tolerate unrecognized request types -- e.g. to
+// round-trip a batch containing one without dropping it -- should decode
+// with decodeRequestMsgpack (via DecodedRequest) instead of RequestUnion
+// directly.
+func (ru *RequestUnion) UnmarshalMsgpack(data []byte) error {
+	decoded, err := decodeRequestMsgpack(data)
+	if err != nil {
+		return err
+	}
+	if decoded.Request == nil {
+		return fmt.Errorf("msgpack: unrecognized request tag %d cannot be represented in RequestUnion; decode with decodeRequestMsgpack instead", decoded.RawTag)
+	}
+	ru.MustSetInner(decoded.Request)
+	return nil
+}
+
+// newRequestForMethod allocates the zero value of the concrete Request
+// type registered for method, mirroring the generated RequestUnion
+// SetValue switch.
+func newRequestForMethod(method Method) (Request, error) {
+	switch method {
+	case Get:
+		return &GetRequest{}, nil
+	case Put:
+		return &PutRequest{}, nil
+	case ConditionalPut:
+		return &ConditionalPutRequest{}, nil
+	case Increment:
+		return &IncrementRequest{}, nil
+	case Delete:
+		return &DeleteRequest{}, nil
+	case DeleteRange:
+		return &DeleteRangeRequest{}, nil
+	case Scan:
+		return &ScanRequest{}, nil
+	case ReverseScan:
+		return &ReverseScanRequest{}, nil
+	case EndTransaction:
+		return &EndTransactionRequest{}, nil
+	case DeprecatedVerifyChecksum:
+		return &DeprecatedVerifyChecksumRequest{}, nil
+	default:
+		return nil, fmt.Errorf("msgpack: no constructor registered for method %s", method)
+	}
+}
+
+// MarshalMsgpack implements MsgpackMarshaler on BatchRequest by encoding
+// the header and each request in Requests through RequestUnion's own
+// msgpack framing.
+func (ba *BatchRequest) MarshalMsgpack() ([]byte, error) {
+	type wire struct {
+		Header   BatchRequest_Header
+		Requests [][]byte
+	}
+	w := wire{Header: ba.Header}
+	for _, ru := range ba.Requests {
+		b, err := ru.MarshalMsgpack()
+		if err != nil {
+			return nil, err
+		}
+		w.Requests = append(w.Requests, b)
+	}
+	return msgpack.Marshal(&w)
+}
+
+// UnmarshalMsgpack implements MsgpackUnmarshaler on BatchRequest.
+func (ba *BatchRequest) UnmarshalMsgpack(data []byte) error {
+	type wire struct {
+		Header   BatchRequest_Header
+		Requests [][]byte
+	}
+	var w wire
+	if err := msgpack.Unmarshal(data, &w); err != nil {
+		return fmt.Errorf("msgpack: decoding BatchRequest: %v", err)
+	}
+	ba.Header = w.Header
+	ba.Requests = ba.Requests[:0]
+	for _, b := range w.Requests {
+		var ru RequestUnion
+		if err := ru.UnmarshalMsgpack(b); err != nil {
+			return err
+		}
+		ba.Requests = append(ba.Requests, ru)
+	}
+	return nil
+}
+
+// newResponseForMethod allocates the zero value of the concrete Response
+// type registered for method, mirroring newRequestForMethod on the
+// response side.
+func newResponseForMethod(method Method) (Response, error) {
+	switch method {
+	case Get:
+		return &GetResponse{}, nil
+	case Put:
+		return &PutResponse{}, nil
+	case ConditionalPut:
+		return &ConditionalPutResponse{}, nil
+	case Increment:
+		return &IncrementResponse{}, nil
+	case Delete:
+		return &DeleteResponse{}, nil
+	case DeleteRange:
+		return &DeleteRangeResponse{}, nil
+	case Scan:
+		return &ScanResponse{}, nil
+	case ReverseScan:
+		return &ReverseScanResponse{}, nil
+	case EndTransaction:
+		return &EndTransactionResponse{}, nil
+	default:
+		// Notably absent: DeprecatedVerifyChecksum. Unlike
+		// newRequestForMethod, this isn't just an omission -- api_test.go
+		// documents RequestUnion.DeprecatedVerifyChecksum as a real,
+		// re-added oneof member, but ResponseUnion has no corresponding
+		// member for it, so a *DeprecatedVerifyChecksumResponse could
+		// never be set into one. Treating it as unrecognized here (same
+		// as any other tag newResponseForMethod doesn't know) routes it
+		// through DecodedResponse's opaque-payload path instead of
+		// letting ResponseUnion.UnmarshalMsgpack's MustSetInner panic.
+		return nil, fmt.Errorf("msgpack: no constructor registered for method %s", method)
+	}
+}
+
+// DecodedResponse is the ResponseUnion counterpart to DecodedRequest: the
+// result of decoding a single msgpack-framed response slot, either a
+// concrete, recognized Response or, for an unrecognized tag, the opaque
+// payload, again without requiring ResponseUnion to have a registered
+// oneof member to hold it in.
+type DecodedResponse struct {
+	// Value is set when the frame's tag was recognized.
+	Value Response
+	// RawTag and RawData are set instead when the tag wasn't recognized.
+	RawTag  int32
+	RawData []byte
+}
+
+// MarshalMsgpack implements MsgpackMarshaler, the inverse of
+// decodeResponseMsgpack.
+func (d DecodedResponse) MarshalMsgpack() ([]byte, error) {
+	if d.Value == nil {
+		return msgpack.Marshal(&msgpackFrame{Version: msgpackSchemaVersion, Tag: d.RawTag, Payload: d.RawData})
+	}
+	tag, ok := requestMsgpackTags[d.Value.Method()]
+	if !ok {
+		return nil, fmt.Errorf("no msgpack tag registered for method %s", d.Value.Method())
+	}
+	payload, err := msgpack.Marshal(d.Value)
+	if err != nil {
+		return nil, fmt.Errorf("msgpack: marshaling %T: %v", d.Value, err)
+	}
+	return msgpack.Marshal(&msgpackFrame{Version: msgpackSchemaVersion, Tag: tag, Payload: payload})
+}
+
+// decodeResponseMsgpack decodes a single msgpack-framed response slot,
+// the ResponseUnion counterpart to decodeRequestMsgpack.
+func decodeResponseMsgpack(data []byte) (DecodedResponse, error) {
+	var frame msgpackFrame
+	if err := msgpack.Unmarshal(data, &frame); err != nil {
+		return DecodedResponse{}, fmt.Errorf("msgpack: decoding frame: %v", err)
+	}
+	if frame.Version != msgpackSchemaVersion {
+		return DecodedResponse{}, fmt.Errorf("msgpack: unsupported schema version %d", frame.Version)
+	}
+	for method, tag := range requestMsgpackTags {
+		if tag != frame.Tag {
+			continue
+		}
+		resp, err := newResponseForMethod(method)
+		if err != nil {
+			// No constructor for this method's response (e.g.
+			// DeprecatedVerifyChecksum, which has no ResponseUnion
+			// member to hold it): fall through to the same opaque-payload
+			// result as a tag this binary's registry doesn't recognize
+			// at all, rather than erroring.
+			break
+		}
+		if err := msgpack.Unmarshal(frame.Payload, resp); err != nil {
+			return DecodedResponse{}, fmt.Errorf("msgpack: decoding %T: %v", resp, err)
+		}
+		return DecodedResponse{Value: resp}, nil
+	}
+	return DecodedResponse{RawTag: frame.Tag, RawData: frame.Payload}, nil
+}
+
+// MarshalMsgpack implements MsgpackMarshaler by framing the inner
+// response behind a schema version and stable type tag.
+func (ru ResponseUnion) MarshalMsgpack() ([]byte, error) {
+	inner := ru.GetValue()
+	if inner == nil {
+		return nil, fmt.Errorf("cannot marshal empty ResponseUnion to msgpack")
+	}
+	return DecodedResponse{Value: inner}.MarshalMsgpack()
+}
+
+// UnmarshalMsgpack implements MsgpackUnmarshaler. Like
+// RequestUnion.UnmarshalMsgpack, it errors on an unrecognized tag rather
+// than panicking; use decodeResponseMsgpack (via DecodedResponse) to
+// tolerate one.
+func (ru *ResponseUnion) UnmarshalMsgpack(data []byte) error {
+	decoded, err := decodeResponseMsgpack(data)
+	if err != nil {
+		return err
+	}
+	if decoded.Value == nil {
+		return fmt.Errorf("msgpack: unrecognized response tag %d cannot be represented in ResponseUnion; decode with decodeResponseMsgpack instead", decoded.RawTag)
+	}
+	ru.MustSetInner(decoded.Value)
+	return nil
+}
+
+// MarshalMsgpack implements MsgpackMarshaler on BatchResponse by encoding
+// the header and each response in Responses through ResponseUnion's own
+// msgpack framing.
+func (br *BatchResponse) MarshalMsgpack() ([]byte, error) {
+	type wire struct {
+		Header    BatchResponse_Header
+		Responses [][]byte
+	}
+	w := wire{Header: br.Header}
+	for _, ru := range br.Responses {
+		b, err := ru.MarshalMsgpack()
+		if err != nil {
+			return nil, err
+		}
+		w.Responses = append(w.Responses, b)
+	}
+	return msgpack.Marshal(&w)
+}
+
+// UnmarshalMsgpack implements MsgpackUnmarshaler on BatchResponse.
+func (br *BatchResponse) UnmarshalMsgpack(data []byte) error {
+	type wire struct {
+		Header    BatchResponse_Header
+		Responses [][]byte
+	}
+	var w wire
+	if err := msgpack.Unmarshal(data, &w); err != nil {
+		return fmt.Errorf("msgpack: decoding BatchResponse: %v", err)
+	}
+	br.Header = w.Header
+	br.Responses = br.Responses[:0]
+	for _, b := range w.Responses {
+		var ru ResponseUnion
+		if err := ru.UnmarshalMsgpack(b); err != nil {
+			return err
+		}
+		br.Responses = append(br.Responses, ru)
+	}
+	return nil
+}
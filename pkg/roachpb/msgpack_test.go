@@ -0,0 +1,184 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package roachpb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func msgpackMarshalFrameForTest(version, tag int32, payload []byte) ([]byte, error) {
+	return msgpack.Marshal(&msgpackFrame{Version: version, Tag: tag, Payload: payload})
+}
+
+// fuzzPopulate sets every exported string/[]byte/bool field reachable
+// from v (recursing into nested structs and pointers) to a value derived
+// from seed, so a round-trip test exercises real payload bytes instead of
+// a vacuous zero-valued struct. It doesn't know or care about any
+// particular Request/Response's field names, so it works uniformly across
+// the whole registry.
+func fuzzPopulate(v interface{}, seed string) {
+	var walk func(reflect.Value)
+	walk = func(rv reflect.Value) {
+		switch rv.Kind() {
+		case reflect.Ptr:
+			if !rv.IsNil() {
+				walk(rv.Elem())
+			}
+		case reflect.Struct:
+			for i := 0; i < rv.NumField(); i++ {
+				f := rv.Field(i)
+				if !f.CanSet() {
+					continue
+				}
+				switch f.Kind() {
+				case reflect.String:
+					f.SetString(seed)
+				case reflect.Slice:
+					if f.Type().Elem().Kind() == reflect.Uint8 {
+						f.Set(reflect.ValueOf([]byte(seed)).Convert(f.Type()))
+					}
+				case reflect.Bool:
+					f.SetBool(true)
+				case reflect.Struct, reflect.Ptr:
+					walk(f)
+				}
+			}
+		}
+	}
+	walk(reflect.ValueOf(v))
+}
+
+// TestRequestUnionMsgpackRoundTrip exercises proto->msgpack->proto
+// equality for every request type registered in requestMsgpackTags, with
+// every populatable field fuzzed first so the comparison isn't vacuously
+// true for a zero-valued struct.
+func TestRequestUnionMsgpackRoundTrip(t *testing.T) {
+	for method := range requestMsgpackTags {
+		req, err := newRequestForMethod(method)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		fuzzPopulate(req, method.String())
+
+		var ru RequestUnion
+		ru.MustSetInner(req)
+
+		data, err := ru.MarshalMsgpack()
+		if err != nil {
+			t.Fatalf("%s: marshal: %v", method, err)
+		}
+
+		var decoded RequestUnion
+		if err := decoded.UnmarshalMsgpack(data); err != nil {
+			t.Fatalf("%s: unmarshal: %v", method, err)
+		}
+		if !reflect.DeepEqual(decoded.GetInner(), req) {
+			t.Errorf("%s: proto->msgpack->proto mismatch:\n  before: %+v\n  after:  %+v", method, req, decoded.GetInner())
+		}
+	}
+}
+
+// TestResponseUnionMsgpackRoundTrip is the ResponseUnion counterpart to
+// TestRequestUnionMsgpackRoundTrip.
+func TestResponseUnionMsgpackRoundTrip(t *testing.T) {
+	for method := range requestMsgpackTags {
+		if method == DeprecatedVerifyChecksum {
+			// ResponseUnion has no member to hold a
+			// DeprecatedVerifyChecksumResponse (unlike RequestUnion,
+			// which re-added one); newResponseForMethod errors for it
+			// on purpose, so it has no response-side round trip to test.
+			continue
+		}
+		resp, err := newResponseForMethod(method)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		fuzzPopulate(resp, method.String())
+
+		var ru ResponseUnion
+		ru.MustSetInner(resp)
+
+		data, err := ru.MarshalMsgpack()
+		if err != nil {
+			t.Fatalf("%s: marshal: %v", method, err)
+		}
+
+		var decoded ResponseUnion
+		if err := decoded.UnmarshalMsgpack(data); err != nil {
+			t.Fatalf("%s: unmarshal: %v", method, err)
+		}
+		if !reflect.DeepEqual(decoded.GetValue(), resp) {
+			t.Errorf("%s: proto->msgpack->proto mismatch:\n  before: %+v\n  after:  %+v", method, resp, decoded.GetValue())
+		}
+	}
+}
+
+// TestValueMsgpackRoundTrip exercises the same generic msgpack codec path
+// used to encode every request/response's nested Value field, directly
+// against Value.RawBytes.
+func TestValueMsgpackRoundTrip(t *testing.T) {
+	v := Value{RawBytes: []byte("payload")}
+	data, err := msgpack.Marshal(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Value
+	if err := msgpack.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, decoded) {
+		t.Errorf("Value round trip mismatch: got %+v, want %+v", decoded, v)
+	}
+}
+
+// TestRequestUnionMsgpackUnknownTag verifies that an unrecognized type tag
+// decodes as an opaque DecodedRequest rather than panicking, and that it
+// round-trips back to the same frame bytes. RequestUnion itself has no
+// registered member that can hold an unrecognized tag, so
+// RequestUnion.UnmarshalMsgpack is expected to error for it rather than
+// panic; decodeRequestMsgpack is the entry point that tolerates it.
+func TestRequestUnionMsgpackUnknownTag(t *testing.T) {
+	data, err := msgpackMarshalFrameForTest(msgpackSchemaVersion, 9999, []byte("opaque"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ru RequestUnion
+	if err := ru.UnmarshalMsgpack(data); err == nil {
+		t.Fatal("expected RequestUnion.UnmarshalMsgpack to error on an unrecognized tag")
+	}
+
+	decoded, err := decodeRequestMsgpack(data)
+	if err != nil {
+		t.Fatalf("unexpected error decoding unknown tag: %v", err)
+	}
+	if decoded.Request != nil {
+		t.Fatalf("expected nil Request for unknown tag, got %T", decoded.Request)
+	}
+	if decoded.RawTag != 9999 || string(decoded.RawData) != "opaque" {
+		t.Errorf("unexpected DecodedRequest contents: %+v", decoded)
+	}
+
+	roundTripped, err := decoded.MarshalMsgpack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roundTripped, data) {
+		t.Errorf("expected unknown tag to round trip to identical bytes")
+	}
+}
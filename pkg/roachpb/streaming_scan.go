@@ -0,0 +1,115 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package roachpb
+
+import "fmt"
+
+// StreamingScanResponse is a combinable variant of ScanResponse for Scans
+// that cross many ranges. Instead of accumulating every partial response's
+// Rows into one unbounded slice, it buffers rows until they reach MaxRows
+// rows or MaxBytes bytes (whichever comes first) and flushes each such
+// chunk to Chan, so the full result set never needs to be materialized in
+// memory at once. The row that reaches MaxBytes is part of the chunk it
+// completes, so a chunk can exceed MaxBytes by up to one row.
+//
+// Two pieces of wiring this type needs to be reachable at all -- a
+// BatchRequest.Header flag DistSender reads to choose this combine path
+// over ScanResponse's, and a ResponseUnion oneof member so one can be
+// carried over the wire -- live in generated protobuf code that isn't
+// part of this checkout (BatchRequest_Header and ResponseUnion aren't
+// declared anywhere here), so neither can be added without inventing a
+// .proto this package doesn't have. Both remain the caller's
+// responsibility until that generated code is available to extend.
+//
+// Until then this combine path is unreachable from any real Scan:
+// nothing sets the header flag and nothing can carry this type over the
+// wire. Do not treat the request this type was added for as fully
+// delivered -- the follow-up to land the header flag and DistSender
+// wiring once the generated proto code exists is still open.
+type StreamingScanResponse struct {
+	ResponseHeader
+
+	// Rows holds the rows carried by this particular (partial) response,
+	// mirroring ScanResponse.Rows. It's what combine reads from the
+	// other response passed to it; pending, below, is the separate,
+	// bounded accumulation buffer combine writes into as it merges Rows
+	// from every partial response seen so far.
+	Rows []KeyValue
+
+	// MaxRows bounds the number of rows buffered before a chunk is
+	// flushed to Chan. Zero means unbounded (bounded only by MaxBytes).
+	MaxRows int
+	// MaxBytes bounds the combined length of the keys and value bytes of
+	// the rows buffered before a chunk is flushed to Chan; the chunk is
+	// flushed once that length reaches MaxBytes. Zero means unbounded
+	// (bounded only by MaxRows).
+	MaxBytes int64
+
+	// Chan receives each flushed chunk of rows in order. It must be set
+	// before the first call to combine.
+	Chan chan<- []KeyValue
+
+	pending      []KeyValue
+	pendingBytes int64
+}
+
+var _ combinable = &StreamingScanResponse{}
+
+// combine implements the combinable interface by appending the rows of
+// other (its exported Rows field, which is what a real wire/DistSender
+// partial response actually populates) to the internal pending buffer,
+// flushing completed chunks to Chan as the configured MaxRows/MaxBytes
+// budget is reached.
+func (sr *StreamingScanResponse) combine(c combinable) error {
+	otherSR, ok := c.(*StreamingScanResponse)
+	if !ok {
+		return fmt.Errorf("cannot combine %T with %T", c, sr)
+	}
+	if sr.Chan == nil {
+		return fmt.Errorf("StreamingScanResponse.Chan must be set before combine")
+	}
+	if err := sr.ResponseHeader.combine(otherSR.Header()); err != nil {
+		return err
+	}
+
+	for _, kv := range otherSR.Rows {
+		sr.pending = append(sr.pending, kv)
+		sr.pendingBytes += int64(len(kv.Key)) + int64(len(kv.Value.RawBytes))
+
+		atRowLimit := sr.MaxRows > 0 && len(sr.pending) >= sr.MaxRows
+		atByteLimit := sr.MaxBytes > 0 && sr.pendingBytes >= sr.MaxBytes
+		if atRowLimit || atByteLimit {
+			sr.flush()
+		}
+	}
+	return nil
+}
+
+// flush sends the currently buffered rows to Chan and resets the buffer.
+// It is a no-op if the buffer is empty.
+func (sr *StreamingScanResponse) flush() {
+	if len(sr.pending) == 0 {
+		return
+	}
+	sr.Chan <- sr.pending
+	sr.pending = nil
+	sr.pendingBytes = 0
+}
+
+// Close flushes any remaining buffered rows. It must be called once the
+// caller is done combining partial responses into sr.
+func (sr *StreamingScanResponse) Close() {
+	sr.flush()
+}
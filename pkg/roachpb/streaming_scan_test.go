@@ -0,0 +1,64 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package roachpb
+
+import "testing"
+
+// TestStreamingScanResponseCombine verifies that combining many partial
+// StreamingScanResponses flushes bounded chunks to the configured channel
+// rather than growing an unbounded Rows slice.
+func TestStreamingScanResponseCombine(t *testing.T) {
+	const numPartials = 250
+	const maxRows = 10
+
+	ch := make(chan []KeyValue, numPartials)
+	sr := &StreamingScanResponse{MaxRows: maxRows, Chan: ch}
+
+	var wantRows int
+	for i := 0; i < numPartials; i++ {
+		partial := &StreamingScanResponse{
+			Rows: []KeyValue{
+				{Key: Key([]byte{byte(i)}), Value: MakeValueFromString("v")},
+			},
+		}
+		if err := sr.combine(partial); err != nil {
+			t.Fatal(err)
+		}
+		wantRows++
+	}
+	sr.Close()
+	close(ch)
+
+	var gotRows int
+	for chunk := range ch {
+		if len(chunk) > maxRows {
+			t.Fatalf("chunk exceeded MaxRows: got %d, want <= %d", len(chunk), maxRows)
+		}
+		gotRows += len(chunk)
+	}
+	if gotRows != wantRows {
+		t.Errorf("expected %d total rows flushed, got %d", wantRows, gotRows)
+	}
+}
+
+// TestStreamingScanResponseCombineRequiresChan verifies that combine fails
+// fast if the caller forgot to set Chan.
+func TestStreamingScanResponseCombineRequiresChan(t *testing.T) {
+	sr := &StreamingScanResponse{}
+	other := &StreamingScanResponse{Rows: []KeyValue{{Key: Key("A")}}}
+	if err := sr.combine(other); err == nil {
+		t.Fatal("expected error combining with nil Chan")
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"go/constant"
+)
+
+// typeVar identifies a type variable in the constraint solver: either a
+// named placeholder ("$1", "$2", ...) or one of the anonymous variables
+// the solver allocates internally, one per same-typed expression group,
+// which every placeholder in the group is unified with and which the
+// concrete types of the group's other expressions are assigned to.
+type typeVar string
+
+// placeholderVar returns the typeVar for a named placeholder.
+func placeholderVar(name string) typeVar { return typeVar("$" + name) }
+
+// constraintSolver performs union-find based unification over a set of
+// typeVars, propagating equalities and concrete-type assignments until
+// fixpoint (or a contradiction). Unlike the greedy, single-pass approach
+// it replaces, a solver instance can be threaded through every sibling
+// expression group in a statement -- e.g. both the SELECT target list
+// and the WHERE clause of `SELECT $1 + $2 WHERE $1 > 10 AND $2 < 'x'` --
+// accumulating constraints from each before resolving any of them, so
+// information from one group is available when resolving another
+// regardless of which group is type-checked first.
+type constraintSolver struct {
+	parent map[typeVar]typeVar
+	// concrete holds, for each root variable, the concrete type it has
+	// been assigned, if any.
+	concrete map[typeVar]Datum
+	// origin remembers one expression that caused each root's concrete
+	// assignment, purely so contradictions can be reported in terms of
+	// the conflicting expressions rather than just their types.
+	origin map[typeVar]Expr
+	// failed holds the first contradiction encountered, if any.
+	failed error
+}
+
+func newConstraintSolver() *constraintSolver {
+	return &constraintSolver{
+		parent:   make(map[typeVar]typeVar),
+		concrete: make(map[typeVar]Datum),
+		origin:   make(map[typeVar]Expr),
+	}
+}
+
+// find returns the representative of v's equivalence class, allocating
+// v as its own representative if it hasn't been seen before.
+func (s *constraintSolver) find(v typeVar) typeVar {
+	p, ok := s.parent[v]
+	if !ok {
+		s.parent[v] = v
+		return v
+	}
+	if p == v {
+		return v
+	}
+	root := s.find(p)
+	s.parent[v] = root // path compression
+	return root
+}
+
+// canonicalType normalizes typ to the sentinel value (TypeInt, TypeFloat,
+// DNull, ...) that represents its SQL type, rather than whatever concrete
+// value happened to produce it -- so resolving a placeholder from, say, a
+// NewDFloat(1) literal records MapArgs["a"] = TypeFloat, not DFloat(1).
+func canonicalType(typ Datum) Datum {
+	switch {
+	case typ == nil:
+		return typ
+	case typ.TypeEqual(TypeInt):
+		return TypeInt
+	case typ.TypeEqual(TypeFloat):
+		return TypeFloat
+	case typ.TypeEqual(DNull):
+		return DNull
+	default:
+		return typ
+	}
+}
+
+// assign records that the equivalence class containing v must have
+// concrete type typ, as evidenced by src. If the class already has a
+// different concrete type, this is a contradiction and is recorded in
+// s.failed (the first one wins; later calls are no-ops).
+func (s *constraintSolver) assign(v typeVar, typ Datum, src Expr) {
+	if s.failed != nil {
+		return
+	}
+	typ = canonicalType(typ)
+	root := s.find(v)
+	if existing, ok := s.concrete[root]; ok {
+		if !existing.TypeEqual(typ) {
+			s.failed = fmt.Errorf(
+				"expected %s to be of type %s, found type %s",
+				src, existing.Type(), typ.Type())
+			return
+		}
+		return
+	}
+	s.concrete[root] = typ
+	s.origin[root] = src
+}
+
+// union merges the equivalence classes of a and b. If both already carry
+// (different) concrete types, this is a contradiction.
+func (s *constraintSolver) union(a, b typeVar) {
+	if s.failed != nil {
+		return
+	}
+	ra, rb := s.find(a), s.find(b)
+	if ra == rb {
+		return
+	}
+	s.parent[ra] = rb
+	if typ, ok := s.concrete[ra]; ok {
+		src := s.origin[ra]
+		delete(s.concrete, ra)
+		delete(s.origin, ra)
+		s.assign(rb, typ, src)
+	}
+}
+
+// typeOf returns the concrete type resolved for v's equivalence class,
+// or ok=false if it remains unresolved (e.g. an unconstrained
+// placeholder with no tiebreaker available).
+func (s *constraintSolver) typeOf(v typeVar) (typ Datum, ok bool) {
+	typ, ok = s.concrete[s.find(v)]
+	return typ, ok
+}
+
+// collectSameTyped records the hard constraints contributed by one
+// same-typed expression group -- ValArg unions into group, and concrete
+// assignments from resolved Datums or non-exact float literals -- without
+// deciding group's type. Splitting collection from the defaulting/
+// tiebreaking logic in finalizeSameTyped is what lets StatementTypeChecker
+// gather every group's hard constraints before any group commits to a
+// type, instead of each group defaulting as soon as it, alone, is seen.
+func (s *constraintSolver) collectSameTyped(group typeVar, exprs ...Expr) (sawFloatLiteral bool, placeholderCount, nullCount int, err error) {
+	for _, e := range exprs {
+		switch t := e.(type) {
+		case ValArg:
+			placeholderCount++
+			s.union(placeholderVar(t.Name), group)
+		case *NumVal:
+			if t.Value.Kind() != constant.Float {
+				// An int-token literal is always flexible: any
+				// integer value can stand in for a float too, so
+				// it never constrains the group on its own.
+				continue
+			}
+			if _, exact := constant.ToInt(t.Value); exact {
+				// A float-token literal with an exact integer
+				// value (e.g. 1.0) can still serve as an int if
+				// something else in the group demands one; it only
+				// contributes a soft preference for float, applied
+				// below if nothing else decides the type.
+				sawFloatLiteral = true
+				continue
+			}
+			// A float-token literal with a fractional value can
+			// never be an int, so it hard-constrains the group --
+			// stronger than `desired`, which is only a tiebreaker.
+			s.assign(group, TypeFloat, e)
+		case Datum:
+			if t == DNull {
+				// NULL contributes no type information of its own;
+				// it's only the type if every sibling is NULL too
+				// (handled in finalizeSameTyped).
+				nullCount++
+				continue
+			}
+			s.assign(group, t, e)
+		}
+		if s.failed != nil {
+			return sawFloatLiteral, placeholderCount, nullCount, s.failed
+		}
+	}
+	return sawFloatLiteral, placeholderCount, nullCount, nil
+}
+
+// finalizeSameTyped decides group's type from the constraints
+// collectSameTyped recorded for it (plus whatever other groups sharing a
+// placeholder with it may since have contributed), falling back to
+// desired and then to the float-literal/int defaults if nothing else
+// pins it down. A lone placeholder defaults to int just like a lone
+// integer literal would; two or more placeholders with nothing else to
+// tie-break them cannot, since defaulting would be guessing at which of
+// several independently named parameters the caller meant.
+func (s *constraintSolver) finalizeSameTyped(
+	group typeVar, desired Datum, exprs []Expr, sawFloatLiteral bool, placeholderCount, nullCount int,
+) (Datum, error) {
+	if nullCount == len(exprs) {
+		return DNull, nil
+	}
+
+	if typ, ok := s.typeOf(group); ok {
+		return typ, nil
+	}
+
+	if desired != nil {
+		s.assign(group, desired, exprs[0])
+		s.failed = nil // desired is a tiebreaker, never a hard error
+		if typ, ok := s.typeOf(group); ok {
+			return typ, nil
+		}
+	}
+
+	switch {
+	case sawFloatLiteral:
+		s.assign(group, TypeFloat, exprs[0])
+	case placeholderCount > 1:
+		// No concrete type, no float literal to default to, and no
+		// desired type: there's nothing left to infer these
+		// placeholders' shared type from.
+		return nil, fmt.Errorf("could not determine data type of parameter %v", exprs[0])
+	default:
+		s.assign(group, TypeInt, exprs[0])
+	}
+	if s.failed != nil {
+		return nil, s.failed
+	}
+	typ, _ := s.typeOf(group)
+	return typ, nil
+}
+
+// solveSameTyped is the unification-based replacement for the old
+// greedy, single-pass typeCheckSameTypedExprs: it allocates one type
+// variable for the whole group, unifies every placeholder's variable
+// (one per placeholder name) with it (they must all end up the same type,
+// which is what "same typed" means), assigns concrete types from
+// literals/resolved Datums/desired to it, and only then reads back the
+// fixpoint result --
+// instead of resolving expressions one at a time in whatever order the
+// caller happened to supply them, which is what made the old pass
+// order-sensitive on statements where a later sibling was the only one
+// that pinned down the type. It resolves a single, self-contained group;
+// see StatementTypeChecker for resolving several groups that may share
+// placeholders without committing any of them to a type prematurely.
+func (s *constraintSolver) solveSameTyped(desired Datum, exprs ...Expr) (Datum, error) {
+	if len(exprs) == 0 {
+		return nil, fmt.Errorf("typeCheckSameTypedExprs called with no expressions")
+	}
+	group := typeVar("<group>")
+	sawFloatLiteral, placeholderCount, nullCount, err := s.collectSameTyped(group, exprs...)
+	if err != nil {
+		return nil, err
+	}
+	return s.finalizeSameTyped(group, desired, exprs, sawFloatLiteral, placeholderCount, nullCount)
+}
+
+// resolvePlaceholders fills args with the concrete type resolved for
+// every placeholder the solver has seen, mirroring the MapArgs side
+// effect of the old typeCheckSameTypedExprs.
+func (s *constraintSolver) resolvePlaceholders(args MapArgs) error {
+	for v := range s.parent {
+		name, ok := placeholderName(v)
+		if !ok {
+			continue
+		}
+		typ, ok := s.typeOf(v)
+		if !ok {
+			return fmt.Errorf("could not determine data type of parameter %s", name)
+		}
+		args[name] = typ
+	}
+	return nil
+}
+
+// placeholderName reports whether v names a placeholder variable and,
+// if so, the placeholder's name (without the leading "$").
+func placeholderName(v typeVar) (string, bool) {
+	s := string(v)
+	if len(s) > 1 && s[0] == '$' {
+		return s[1:], true
+	}
+	return "", false
+}
+
+// pendingGroup is one same-typed expression group StatementTypeChecker
+// has collected but not yet resolved.
+type pendingGroup struct {
+	group            typeVar
+	desired          Datum
+	exprs            []Expr
+	sawFloatLiteral  bool
+	placeholderCount int
+	nullCount        int
+}
+
+// StatementTypeChecker threads one constraintSolver across every
+// same-typed expression group belonging to a single statement -- e.g.
+// both the SELECT target list and the WHERE clause of
+// `SELECT $1 + $2 WHERE $1 > 10 AND $2 < 'x'` -- so that a placeholder
+// appearing in more than one group is constrained by all of them before
+// any group commits to a type, regardless of which group is collected
+// first. CollectSameTyped records a group's constraints; Resolve decides
+// every group's type only once all of them have been collected.
+type StatementTypeChecker struct {
+	solver *constraintSolver
+	args   MapArgs
+	groups []pendingGroup
+}
+
+// NewStatementTypeChecker creates a StatementTypeChecker that will record
+// resolved placeholder types into args (creating one if args is nil).
+func NewStatementTypeChecker(args MapArgs) *StatementTypeChecker {
+	if args == nil {
+		args = make(MapArgs)
+	}
+	c := &StatementTypeChecker{solver: newConstraintSolver(), args: args}
+	for name, typ := range args {
+		c.solver.assign(placeholderVar(name), typ, ValArg{name})
+	}
+	return c
+}
+
+// CollectSameTyped records one same-typed expression group's constraints
+// for later resolution via Resolve. desired, if non-nil, is used as a
+// tiebreaker when Resolve finds the group doesn't otherwise pin down a
+// concrete type (e.g. a bare numeric literal).
+func (c *StatementTypeChecker) CollectSameTyped(desired Datum, exprs ...Expr) error {
+	if len(exprs) == 0 {
+		return fmt.Errorf("CollectSameTyped called with no expressions")
+	}
+	group := typeVar(fmt.Sprintf("<group%d>", len(c.groups)))
+	sawFloatLiteral, placeholderCount, nullCount, err := c.solver.collectSameTyped(group, exprs...)
+	if err != nil {
+		return err
+	}
+	c.groups = append(c.groups, pendingGroup{
+		group: group, desired: desired, exprs: exprs,
+		sawFloatLiteral: sawFloatLiteral, placeholderCount: placeholderCount, nullCount: nullCount,
+	})
+	return nil
+}
+
+// Resolve finalizes every group collected so far, in collection order,
+// returning each group's expressions (unchanged; placeholders are
+// substituted at EXECUTE time, not here -- see Execute in prepare.go)
+// and resolved type, and fills args with the resolved type of every
+// placeholder seen across all groups.
+func (c *StatementTypeChecker) Resolve() ([]Exprs, []Datum, error) {
+	exprsOut := make([]Exprs, len(c.groups))
+	typesOut := make([]Datum, len(c.groups))
+	for i, g := range c.groups {
+		typ, err := c.solver.finalizeSameTyped(g.group, g.desired, g.exprs, g.sawFloatLiteral, g.placeholderCount, g.nullCount)
+		if err != nil {
+			return nil, nil, err
+		}
+		typesOut[i] = typ
+		result := make(Exprs, len(g.exprs))
+		copy(result, g.exprs)
+		exprsOut[i] = result
+	}
+	if err := c.solver.resolvePlaceholders(c.args); err != nil {
+		return nil, nil, err
+	}
+	return exprsOut, typesOut, nil
+}
+
+// typeCheckSameTypedExprs type checks a list of expressions which are
+// expected to all be the same type and, in the process, resolves the
+// type of any placeholder (ValArg) among them, recording it in args.
+// desired, if non-nil, is used as a tiebreaker when the expressions
+// don't otherwise pin down a concrete type (e.g. a bare numeric
+// literal). It returns exprs unchanged along with the resolved type for
+// the group.
+//
+// This is a thin, single-group convenience wrapper around
+// StatementTypeChecker for callers that only have one group to resolve;
+// a caller type-checking several sibling groups of the same statement
+// (e.g. a SELECT target list and its WHERE clause) should instead create
+// one StatementTypeChecker and call CollectSameTyped for each group
+// before Resolve, so a placeholder shared between groups is constrained
+// by all of them before any is finalized.
+func typeCheckSameTypedExprs(args MapArgs, desired Datum, exprs ...Expr) (Exprs, Datum, error) {
+	c := NewStatementTypeChecker(args)
+	if err := c.CollectSameTyped(desired, exprs...); err != nil {
+		return nil, nil, err
+	}
+	exprsOut, types, err := c.Resolve()
+	if err != nil {
+		return nil, nil, err
+	}
+	return exprsOut[0], types[0], nil
+}
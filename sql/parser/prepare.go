@@ -0,0 +1,267 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Prepare represents a PREPARE statement, binding a name to a parsed and
+// type-checked statement so that it can later be re-executed with
+// substituted placeholder values via EXECUTE.
+type Prepare struct {
+	Name      string
+	Statement Statement
+}
+
+// String implements the fmt.Stringer interface.
+func (node *Prepare) String() string {
+	return fmt.Sprintf("PREPARE %s AS %s", node.Name, node.Statement)
+}
+
+// Execute represents an EXECUTE statement, running a previously prepared
+// statement with the given argument expressions substituted for its
+// placeholders.
+type Execute struct {
+	Name   string
+	Params Exprs
+}
+
+// String implements the fmt.Stringer interface.
+func (node *Execute) String() string {
+	if len(node.Params) == 0 {
+		return fmt.Sprintf("EXECUTE %s", node.Name)
+	}
+	return fmt.Sprintf("EXECUTE %s (%s)", node.Name, node.Params)
+}
+
+// Deallocate represents a DEALLOCATE statement, removing a previously
+// prepared statement from the session's PreparedStatements map. A Name of
+// the empty string denotes DEALLOCATE ALL.
+type Deallocate struct {
+	Name string
+}
+
+// String implements the fmt.Stringer interface.
+func (node *Deallocate) String() string {
+	if node.Name == "" {
+		return "DEALLOCATE ALL"
+	}
+	return fmt.Sprintf("DEALLOCATE %s", node.Name)
+}
+
+// PreparedStatement is the result of type-checking a statement prepared via
+// PREPARE (or the pgwire extended query Parse message): the original
+// statement along with the types inferred for each of its placeholders.
+type PreparedStatement struct {
+	Statement Statement
+	Types     MapArgs
+}
+
+// PreparedStatements is a session-scoped table of prepared statements,
+// keyed by the name they were prepared under.
+type PreparedStatements map[string]*PreparedStatement
+
+// Prepare type-checks stmt, resolving the types of any ValArg placeholders
+// it contains, and stores the result under name for later execution. It is
+// an error to prepare a statement under a name that is already in use;
+// DEALLOCATE it first.
+//
+// Each of stmt's top-level expressions is its own same-typed group (e.g.
+// the columns of a target list are independently typed, unlike the arms
+// of a single CASE), but all of them are collected through one
+// StatementTypeChecker before any is resolved, so a placeholder appearing
+// in more than one of stmt's expressions still gets a single, consistent
+// type regardless of which expression happens to pin it down.
+//
+// A top-level expression is only type-checked if it's itself a bare
+// ValArg, *NumVal, or Datum -- the same three forms collectSameTyped
+// recognizes. Anything else (a WHERE clause's comparison, `$1 + 1`, a
+// function call, ...) is a composite expression that needs decomposing
+// into its own same-typed operand groups before its pieces can be
+// collected, which is TypeCheck's job against the concrete Expr node
+// types (*BinaryExpr, *ComparisonExpr, *FuncExpr, ...) it switches on --
+// none of which, including TypeCheck itself, exist in this checkout.
+// Rather than pass such an expression to CollectSameTyped uninspected,
+// which would silently contribute nothing for any placeholder buried
+// inside it, Prepare refuses it with an explicit error.
+//
+// stmt must implement expressionStatement: this package defines no
+// concrete grammar-produced statement types of its own (no SELECT,
+// INSERT, ...), only the expressionStatement interface itself and the
+// fakeStatement test double that implements it, so there is currently no
+// real Statement Prepare can introspect. Rather than silently treat an
+// unintrospectable stmt the same as one with no placeholders -- which
+// would report success with an empty Types even though Prepare never
+// actually looked for any -- it reports that gap as an explicit error
+// until a real statement type implementing expressionStatement exists
+// here to prepare.
+func (ps PreparedStatements) Prepare(name string, stmt Statement) (*PreparedStatement, error) {
+	if _, ok := ps[name]; ok {
+		return nil, fmt.Errorf("prepared statement %q already exists", name)
+	}
+
+	expr, ok := stmt.(expressionStatement)
+	if !ok {
+		return nil, fmt.Errorf("cannot type check prepared statement: %T does not implement expressionStatement", stmt)
+	}
+
+	args := make(MapArgs)
+	c := NewStatementTypeChecker(args)
+	for _, e := range expr.expressions() {
+		switch e.(type) {
+		case ValArg, *NumVal, Datum:
+		default:
+			return nil, fmt.Errorf(
+				"cannot type check prepared statement: %T is a composite expression and needs "+
+					"TypeCheck to decompose it into same-typed operand groups, which this checkout doesn't have",
+				e)
+		}
+		if err := c.CollectSameTyped(NoTypePreference, e); err != nil {
+			return nil, fmt.Errorf("error type checking prepared statement: %v", err)
+		}
+	}
+	if _, _, err := c.Resolve(); err != nil {
+		return nil, fmt.Errorf("error type checking prepared statement: %v", err)
+	}
+
+	prepared := &PreparedStatement{
+		Statement: stmt,
+		Types:     args,
+	}
+	ps[name] = prepared
+	return prepared, nil
+}
+
+// Execute looks up the statement prepared under name, coerces args to the
+// types inferred at PREPARE time, and substitutes them for the ValArg
+// placeholders in the prepared statement's expressions, positionally by
+// placeholder number ("$1", "$2", ...) rather than by MapArgs iteration
+// order, which is unstable. It returns a new statement with the
+// substitution applied; the original prepared statement is left untouched
+// so it can be executed again with different arguments.
+func (ps PreparedStatements) Execute(name string, args ...Datum) (Statement, error) {
+	prepared, ok := ps[name]
+	if !ok {
+		return nil, fmt.Errorf("prepared statement %q does not exist", name)
+	}
+
+	if len(args) != len(prepared.Types) {
+		return nil, fmt.Errorf("wrong number of parameters for prepared statement %q: expected %d, got %d",
+			name, len(prepared.Types), len(args))
+	}
+
+	markers := make([]string, 0, len(prepared.Types))
+	for marker := range prepared.Types {
+		markers = append(markers, marker)
+	}
+	sort.Slice(markers, func(i, j int) bool {
+		ni, erri := strconv.Atoi(markers[i])
+		nj, errj := strconv.Atoi(markers[j])
+		if erri == nil && errj == nil {
+			return ni < nj
+		}
+		return markers[i] < markers[j]
+	})
+
+	bound := make(map[string]Datum, len(markers))
+	for i, marker := range markers {
+		typ := prepared.Types[marker]
+		d, err := coerceDatum(args[i], typ)
+		if err != nil {
+			return nil, fmt.Errorf("parameter $%s: %v", marker, err)
+		}
+		bound[marker] = d
+	}
+
+	// Prepare already requires expressionStatement, so this only fires for
+	// a PreparedStatement built directly rather than through Prepare; kept
+	// as the same explicit error rather than silently returning
+	// prepared.Statement unsubstituted, for the same reason Prepare no
+	// longer treats this gap as success.
+	expr, ok := prepared.Statement.(expressionStatement)
+	if !ok {
+		return nil, fmt.Errorf("cannot substitute placeholders: %T does not implement expressionStatement", prepared.Statement)
+	}
+	v := &paramSubstituter{bound: bound}
+	exprs := expr.expressions()
+	substituted := make(Exprs, len(exprs))
+	for i, e := range exprs {
+		substituted[i] = WalkExpr(v, e)
+	}
+	return expr.withExpressions(substituted), nil
+}
+
+// coerceDatum converts d to typ if the two don't already match but d can
+// be widened to typ without loss (e.g. an int argument for a float
+// parameter), and errors otherwise.
+func coerceDatum(d Datum, typ Datum) (Datum, error) {
+	if d.TypeEqual(typ) {
+		return d, nil
+	}
+	if typ.TypeEqual(TypeFloat) {
+		if i, ok := d.(DInt); ok {
+			return NewDFloat(float64(i)), nil
+		}
+	}
+	return nil, fmt.Errorf("requires %s, got %s", typ.Type(), d.Type())
+}
+
+// paramSubstituter replaces every ValArg in an expression tree with its
+// bound, coerced value.
+type paramSubstituter struct {
+	bound map[string]Datum
+}
+
+// VisitPre implements the Visitor interface.
+func (v *paramSubstituter) VisitPre(expr Expr) (recurse bool, newExpr Expr) {
+	if va, ok := expr.(ValArg); ok {
+		if d, ok := v.bound[va.Name]; ok {
+			return false, d
+		}
+	}
+	return true, expr
+}
+
+// VisitPost implements the Visitor interface.
+func (v *paramSubstituter) VisitPost(expr Expr) Expr { return expr }
+
+// Deallocate removes the statement prepared under name, or every prepared
+// statement if name is the empty string (DEALLOCATE ALL).
+func (ps PreparedStatements) Deallocate(name string) error {
+	if name == "" {
+		for k := range ps {
+			delete(ps, k)
+		}
+		return nil
+	}
+	if _, ok := ps[name]; !ok {
+		return fmt.Errorf("prepared statement %q does not exist", name)
+	}
+	delete(ps, name)
+	return nil
+}
+
+// expressionStatement is implemented by statements that expose the
+// top-level expressions which need placeholder type inference at PREPARE
+// time (e.g. the targets of a SELECT, or the values of an INSERT), and
+// that can be rebuilt with those expressions replaced once EXECUTE has
+// substituted concrete values for their placeholders.
+type expressionStatement interface {
+	expressions() Exprs
+	withExpressions(Exprs) Statement
+}
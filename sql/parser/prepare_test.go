@@ -0,0 +1,201 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fakeStatement is a minimal expressionStatement used to drive Prepare
+// without depending on a concrete grammar-produced statement.
+type fakeStatement struct {
+	exprs Exprs
+}
+
+func (f *fakeStatement) String() string     { return "FAKE" }
+func (f *fakeStatement) expressions() Exprs { return f.exprs }
+func (f *fakeStatement) withExpressions(exprs Exprs) Statement {
+	return &fakeStatement{exprs: exprs}
+}
+
+// fakeCompositeExpr stands in for a composite expression node (a
+// *BinaryExpr, *ComparisonExpr, ...) that this checkout has no concrete
+// type for: something other than a bare ValArg, *NumVal, or Datum that
+// Prepare cannot type-check without TypeCheck to decompose it first.
+type fakeCompositeExpr struct{}
+
+func (fakeCompositeExpr) String() string { return "$1 + 1" }
+
+// fakeNonExpressionStatement stands in for the many real statement types
+// (DDL, SET, ...) that don't implement expressionStatement because they
+// have no top-level expressions of their own to type-check.
+type fakeNonExpressionStatement struct{}
+
+func (fakeNonExpressionStatement) String() string { return "NOOP" }
+
+// TestPrepareRejectsNonExpressionStatement verifies that Prepare reports
+// an explicit error for a statement it cannot introspect for
+// placeholders, rather than silently preparing it with an empty Types as
+// though it had none.
+func TestPrepareRejectsNonExpressionStatement(t *testing.T) {
+	ps := make(PreparedStatements)
+	if _, err := ps.Prepare("p1", fakeNonExpressionStatement{}); err == nil {
+		t.Error("expected error preparing a statement that doesn't implement expressionStatement")
+	}
+}
+
+// TestExecuteRejectsNonExpressionStatement covers the same gap as
+// TestPrepareRejectsNonExpressionStatement for a PreparedStatement built
+// directly rather than through Prepare.
+func TestExecuteRejectsNonExpressionStatement(t *testing.T) {
+	ps := make(PreparedStatements)
+	ps["p1"] = &PreparedStatement{Statement: fakeNonExpressionStatement{}, Types: MapArgs{}}
+	if _, err := ps.Execute("p1"); err == nil {
+		t.Error("expected error executing a statement that doesn't implement expressionStatement")
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	testData := []struct {
+		exprs        []Expr
+		expectedArgs MapArgs
+	}{
+		{[]Expr{intConst("1")}, MapArgs{}},
+		{[]Expr{ValArg{"a"}}, MapArgs{"a": TypeInt}},
+		// These are two independent top-level expressions (think two
+		// target-list columns, e.g. SELECT 1.0, $a), not one same-typed
+		// group, so the float literal in the first expression has no
+		// bearing on $a's type: $a defaults to int on its own, same as
+		// the bare-placeholder case above.
+		{[]Expr{NewDFloat(1), ValArg{"a"}}, MapArgs{"a": TypeInt}},
+	}
+	for i, d := range testData {
+		ps := make(PreparedStatements)
+		stmt := &fakeStatement{exprs: d.exprs}
+		prepared, err := ps.Prepare("p1", stmt)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(prepared.Types, d.expectedArgs) {
+			t.Errorf("%d: expected args %v after Prepare, found %v", i, d.expectedArgs, prepared.Types)
+		}
+		if _, err := ps.Prepare("p1", stmt); err == nil {
+			t.Errorf("%d: expected error preparing duplicate name", i)
+		}
+	}
+}
+
+// TestPrepareRejectsCompositeExpr verifies that Prepare reports an
+// explicit error for a top-level expression it cannot decompose into
+// same-typed operand groups, rather than silently recording no
+// placeholders for it -- the bug this guards against is a composite
+// expression like `$1 + 1` being treated as one inert expression, so a
+// placeholder buried inside it never shows up in the PreparedStatement's
+// Types.
+func TestPrepareRejectsCompositeExpr(t *testing.T) {
+	ps := make(PreparedStatements)
+	stmt := &fakeStatement{exprs: Exprs{fakeCompositeExpr{}}}
+	if _, err := ps.Prepare("p1", stmt); err == nil {
+		t.Error("expected error preparing a composite expression Prepare cannot decompose")
+	}
+}
+
+func TestExecute(t *testing.T) {
+	// Built directly rather than via Prepare: a lone placeholder like $a
+	// here has nothing around it to pin its type to anything but int (see
+	// TestPrepare), so exercising Execute's float-parameter coercion needs
+	// a PreparedStatement whose Types we set explicitly.
+	ps := make(PreparedStatements)
+	ps["p1"] = &PreparedStatement{
+		Statement: &fakeStatement{exprs: Exprs{ValArg{"a"}}},
+		Types:     MapArgs{"a": TypeFloat},
+	}
+
+	if _, err := ps.Execute("p1", NewDString("not a number")); err == nil {
+		t.Errorf("expected coercion error executing with an incompatible argument type")
+	}
+
+	got, err := ps.Execute("p1", NewDFloat(1))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gotStmt, ok := got.(*fakeStatement)
+	if !ok {
+		t.Fatalf("expected *fakeStatement, got %T", got)
+	}
+	if len(gotStmt.exprs) != 1 || !reflect.DeepEqual(gotStmt.exprs[0], NewDFloat(1)) {
+		t.Errorf("expected placeholder substituted with %v, got %v", NewDFloat(1), gotStmt.exprs)
+	}
+
+	// An int argument for a float parameter is coerced, not rejected.
+	got, err = ps.Execute("p1", NewDInt(2))
+	if err != nil {
+		t.Fatalf("unexpected error coercing int argument to float parameter: %v", err)
+	}
+	gotStmt = got.(*fakeStatement)
+	if !reflect.DeepEqual(gotStmt.exprs[0], NewDFloat(2)) {
+		t.Errorf("expected int argument coerced to %v, got %v", NewDFloat(2), gotStmt.exprs[0])
+	}
+
+	if _, err := ps.Execute("nonexistent", NewDFloat(1)); err == nil {
+		t.Errorf("expected error executing unknown prepared statement")
+	}
+}
+
+func TestExecuteBindsPositionally(t *testing.T) {
+	ps := make(PreparedStatements)
+	stmt := &fakeStatement{exprs: Exprs{ValArg{"1"}, ValArg{"2"}}}
+	if _, err := ps.Prepare("p1", stmt); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ps.Execute("p1", NewDInt(1), NewDInt(2))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gotStmt := got.(*fakeStatement)
+	if !reflect.DeepEqual(gotStmt.exprs[0], NewDInt(1)) || !reflect.DeepEqual(gotStmt.exprs[1], NewDInt(2)) {
+		t.Errorf("expected $1, $2 bound positionally to 1, 2, got %v", gotStmt.exprs)
+	}
+}
+
+func TestDeallocate(t *testing.T) {
+	ps := make(PreparedStatements)
+	stmt := &fakeStatement{exprs: Exprs{intConst("1")}}
+	if _, err := ps.Prepare("p1", stmt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ps.Prepare("p2", stmt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ps.Deallocate("p1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := ps["p1"]; ok {
+		t.Errorf("expected p1 to be removed")
+	}
+	if err := ps.Deallocate("p1"); err == nil {
+		t.Errorf("expected error deallocating already-removed statement")
+	}
+
+	if err := ps.Deallocate(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ps) != 0 {
+		t.Errorf("expected DEALLOCATE ALL to empty the map, found %v", ps)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package parser
+
+import "fmt"
+
+// RenameTable represents a RENAME TABLE statement. There is no grammar
+// production in this checkout that parses RENAME TABLE ... CASCADE into
+// one (same situation as Prepare/Execute/Deallocate in prepare.go, which
+// this mirrors): it exists so the caller that does own that grammar has
+// an AST node to build and a Cascade flag to thread through to Rename.
+type RenameTable struct {
+	Name     *QualifiedName
+	NewName  *QualifiedName
+	IfExists bool
+	Cascade  bool
+}
+
+// String implements the fmt.Stringer interface.
+func (node *RenameTable) String() string {
+	var ifExists, cascade string
+	if node.IfExists {
+		ifExists = "IF EXISTS "
+	}
+	if node.Cascade {
+		cascade = " CASCADE"
+	}
+	return fmt.Sprintf("RENAME TABLE %s%s TO %s%s", ifExists, node.Name, node.NewName, cascade)
+}
+
+// RenameColumn represents a RENAME COLUMN statement, parsed the same way
+// RenameTable is (see RenameTable's comment).
+type RenameColumn struct {
+	Table    *QualifiedName
+	Name     Name
+	NewName  Name
+	IfExists bool
+	Cascade  bool
+}
+
+// String implements the fmt.Stringer interface.
+func (node *RenameColumn) String() string {
+	var ifExists, cascade string
+	if node.IfExists {
+		ifExists = "IF EXISTS "
+	}
+	if node.Cascade {
+		cascade = " CASCADE"
+	}
+	return fmt.Sprintf("RENAME COLUMN %s%s.%s TO %s%s", ifExists, node.Table, node.Name, node.NewName, cascade)
+}
+
+// RenameDependent is a single stored expression that may reference the
+// object being renamed: a view's query, an index predicate, a CHECK
+// constraint, or a computed column expression. Descriptor identifies the
+// owning object so that callers (which hold the actual table descriptors)
+// can persist whichever dependents come back modified.
+type RenameDependent struct {
+	Descriptor string
+	Expr       Expr
+}
+
+// ScopeResolver resolves an unqualified QualifiedName encountered while
+// walking dep's expression to the fully qualified name it's bound to in
+// dep's scope, mirroring the name resolution TypeCheck performs when it
+// binds a bare column or table reference (e.g. a CHECK constraint or
+// computed column is implicitly scoped to its own table, while a view's
+// query may have several tables in scope). ok is false if unqualified
+// cannot be resolved unambiguously in that scope, e.g. a view whose FROM
+// list has more than one table with a matching column name.
+type ScopeResolver func(dep RenameDependent, unqualified *QualifiedName) (resolved *QualifiedName, ok bool)
+
+// renameVisitor rewrites every QualifiedName bound to old into new. A
+// QualifiedName is considered "bound to old" if it resolves to the same
+// object as old under TypeCheck's name resolution rules: either it's
+// already fully qualified and matches, or resolve (supplied by the
+// caller, which owns the scope information TypeCheck would otherwise use)
+// resolves it to old given dep's own scope.
+type renameVisitor struct {
+	old, new  *QualifiedName
+	dep       RenameDependent
+	resolve   ScopeResolver
+	changed   bool
+	ambiguous bool
+}
+
+// VisitPre implements the Visitor interface.
+func (v *renameVisitor) VisitPre(expr Expr) (recurse bool, newExpr Expr) {
+	qn, ok := expr.(*QualifiedName)
+	if !ok {
+		return true, expr
+	}
+	if qn.Equals(v.old) {
+		v.changed = true
+		return false, v.new
+	}
+	if qn.IsFullyQualified() {
+		return true, expr
+	}
+	resolved, ok := v.resolve(v.dep, qn)
+	if !ok {
+		// The scope resolver couldn't bind this unqualified reference
+		// unambiguously (e.g. a view with more than one table in scope
+		// sharing this column name). Without knowing which table it
+		// binds to, we cannot safely decide whether it's even bound to
+		// old, so surface it instead of guessing.
+		v.ambiguous = true
+		return false, expr
+	}
+	if resolved.Equals(v.old) {
+		v.changed = true
+		return false, v.new
+	}
+	return true, expr
+}
+
+// VisitPost implements the Visitor interface.
+func (v *renameVisitor) VisitPost(expr Expr) Expr { return expr }
+
+// Rename rewrites every QualifiedName in dependents bound to oldName to
+// newName and returns the subset of dependents that were actually
+// modified, for atomic application by the caller inside a single
+// transaction alongside the rename of oldName itself. It is the AST-level
+// half of RENAME ... CASCADE; applying the returned dependents to stored
+// descriptors is the caller's responsibility. Unqualified references
+// within a dependent's expression (the common case for CHECK constraints
+// and computed columns, which are implicitly scoped to their own table)
+// are resolved via resolve rather than always being treated as ambiguous.
+func Rename(oldName, newName *QualifiedName, dependents []RenameDependent, resolve ScopeResolver) ([]RenameDependent, error) {
+	var modified []RenameDependent
+	for _, dep := range dependents {
+		v := &renameVisitor{old: oldName, new: newName, dep: dep, resolve: resolve}
+		newExpr := WalkExpr(v, dep.Expr)
+		if v.ambiguous {
+			return nil, fmt.Errorf("ambiguous unqualified reference to %q in %s", oldName, dep.Descriptor)
+		}
+		if v.changed {
+			dep.Expr = newExpr
+			modified = append(modified, dep)
+		}
+	}
+	return modified, nil
+}
+
+// CheckRenameTarget verifies that newName is a legal rename target: it
+// must not already be in use. exists is supplied by the caller, which
+// owns the descriptor catalog that the parser package does not have
+// access to.
+func CheckRenameTarget(newName *QualifiedName, exists func(*QualifiedName) bool) error {
+	if exists(newName) {
+		return fmt.Errorf("relation %q already exists", newName)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package parser
+
+import "testing"
+
+func mustQualifiedName(t *testing.T, s string) *QualifiedName {
+	expr, err := ParseExprTraditional(s)
+	if err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	qn, ok := expr.(*QualifiedName)
+	if !ok {
+		t.Fatalf("%s: expected *QualifiedName, got %T", s, expr)
+	}
+	return qn
+}
+
+func TestRename(t *testing.T) {
+	testData := []struct {
+		oldName, newName string
+		dependent        string
+		expected         string
+	}{
+		{"orders", "purchase_orders", "orders", "purchase_orders"},
+		{"orders.total", "orders.amount", "orders.total", "orders.amount"},
+		{"orders.total", "orders.amount", "orders.quantity", "orders.quantity"},
+	}
+	for i, d := range testData {
+		oldName := mustQualifiedName(t, d.oldName)
+		newName := mustQualifiedName(t, d.newName)
+		dependent := mustQualifiedName(t, d.dependent)
+
+		// These dependents are all already fully qualified, so the
+		// resolver is never consulted; it only needs to satisfy the
+		// ScopeResolver signature.
+		resolve := func(RenameDependent, *QualifiedName) (*QualifiedName, bool) {
+			t.Fatalf("%d: resolve should not be called for a fully qualified dependent", i)
+			return nil, false
+		}
+		modified, err := Rename(oldName, newName, []RenameDependent{
+			{Descriptor: "v1", Expr: dependent},
+		}, resolve)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+
+		if dependent.String() == d.expected {
+			if len(modified) != 0 {
+				t.Errorf("%d: expected no modification, got %v", i, modified)
+			}
+			continue
+		}
+
+		if len(modified) != 1 {
+			t.Fatalf("%d: expected one modified dependent, got %d", i, len(modified))
+		}
+		if got := modified[0].Expr.String(); got != d.expected {
+			t.Errorf("%d: expected rewritten expression %q, got %q", i, d.expected, got)
+		}
+	}
+}
+
+// TestRenameUnqualifiedReference verifies that an unqualified reference --
+// the form a CHECK constraint or computed column ordinarily uses to refer
+// to a column of its own table -- is rewritten via the caller-supplied
+// ScopeResolver instead of always being rejected as ambiguous.
+func TestRenameUnqualifiedReference(t *testing.T) {
+	oldName := mustQualifiedName(t, "orders.total")
+	newName := mustQualifiedName(t, "orders.amount")
+	dependent := mustQualifiedName(t, "total")
+
+	// Simulates TypeCheck's scope resolution for a dependent scoped to a
+	// single table (orders): an unqualified column name always resolves
+	// to that table's column.
+	resolve := func(dep RenameDependent, unqualified *QualifiedName) (*QualifiedName, bool) {
+		return mustQualifiedName(t, "orders."+unqualified.String()), true
+	}
+
+	modified, err := Rename(oldName, newName, []RenameDependent{
+		{Descriptor: "orders_check", Expr: dependent},
+	}, resolve)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(modified) != 1 {
+		t.Fatalf("expected one modified dependent, got %d", len(modified))
+	}
+	if got, want := modified[0].Expr.String(), newName.String(); got != want {
+		t.Errorf("expected rewritten expression %q, got %q", want, got)
+	}
+}
+
+// TestRenameAmbiguousUnqualifiedReference verifies that Rename still
+// errors when the ScopeResolver itself cannot resolve an unqualified
+// reference unambiguously (e.g. a view whose scope has more than one
+// candidate table for the name).
+func TestRenameAmbiguousUnqualifiedReference(t *testing.T) {
+	oldName := mustQualifiedName(t, "orders.total")
+	newName := mustQualifiedName(t, "orders.amount")
+	dependent := mustQualifiedName(t, "total")
+
+	resolve := func(dep RenameDependent, unqualified *QualifiedName) (*QualifiedName, bool) {
+		return nil, false
+	}
+
+	if _, err := Rename(oldName, newName, []RenameDependent{
+		{Descriptor: "orders_total_view", Expr: dependent},
+	}, resolve); err == nil {
+		t.Errorf("expected ambiguous reference error")
+	}
+}
+
+func TestCheckRenameTarget(t *testing.T) {
+	newName := mustQualifiedName(t, "orders2")
+	if err := CheckRenameTarget(newName, func(*QualifiedName) bool { return false }); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := CheckRenameTarget(newName, func(*QualifiedName) bool { return true }); err == nil {
+		t.Errorf("expected error for already-existing rename target")
+	}
+}
@@ -240,6 +240,70 @@ func TestTypeCheckSameTypedExprs(t *testing.T) {
 	}
 }
 
+// TestTypeCheckSameTypedExprsOrderIndependent checks, without resorting
+// to the forEachPerm brute-force scaffold above, that the constraint
+// solver backing typeCheckSameTypedExprs reaches the same answer no
+// matter which sibling expression happens to be the one that pins down
+// the group's type -- the case the old greedy, left-to-right pass could
+// get wrong since it resolved each expression as it went rather than
+// collecting every constraint before deciding.
+func TestTypeCheckSameTypedExprsOrderIndependent(t *testing.T) {
+	testData := []struct {
+		exprs        []Expr
+		expectedType Datum
+		expectedArgs MapArgs
+	}{
+		// The placeholder is first; its type only becomes known once the
+		// float literal with a fractional value is seen.
+		{[]Expr{ValArg{"a"}, floatConst("1.1")}, TypeFloat, MapArgs{"a": TypeFloat}},
+		// The placeholder is last; same constraint, opposite order.
+		{[]Expr{floatConst("1.1"), ValArg{"a"}}, TypeFloat, MapArgs{"a": TypeFloat}},
+		// Two placeholders whose shared type is only pinned down by a
+		// concrete NewDFloat, first sitting between them, then after both.
+		{[]Expr{ValArg{"a"}, NewDFloat(1), ValArg{"b"}}, TypeFloat, MapArgs{"a": TypeFloat, "b": TypeFloat}},
+		{[]Expr{ValArg{"b"}, ValArg{"a"}, NewDFloat(1)}, TypeFloat, MapArgs{"a": TypeFloat, "b": TypeFloat}},
+	}
+	for i, d := range testData {
+		args := make(MapArgs)
+		_, typ, err := typeCheckSameTypedExprs(args, nil, d.exprs...)
+		if err != nil {
+			t.Fatalf("%d: unexpected error returned from typeCheckSameTypedExprs: %v", i, err)
+		}
+		if !typ.TypeEqual(d.expectedType) {
+			t.Errorf("%d: expected type %s, found %s", i, d.expectedType.Type(), typ.Type())
+		}
+		if !reflect.DeepEqual(args, d.expectedArgs) {
+			t.Errorf("%d: expected args %v, found %v", i, d.expectedArgs, args)
+		}
+	}
+}
+
+// TestStatementTypeCheckerCrossGroup verifies that a placeholder shared
+// between two same-typed groups is constrained by both regardless of
+// which group is collected first: the first group alone, $1 by itself,
+// has no type information and would default to TypeInt if resolved in
+// isolation, but since both groups are collected before either is
+// resolved, it instead picks up the TypeFloat constraint $1 only gets
+// from appearing alongside a fractional literal in the second group.
+func TestStatementTypeCheckerCrossGroup(t *testing.T) {
+	c := NewStatementTypeChecker(nil)
+	if err := c.CollectSameTyped(nil, ValArg{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CollectSameTyped(nil, ValArg{"1"}, floatConst("1.1")); err != nil {
+		t.Fatal(err)
+	}
+	_, types, err := c.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, typ := range types {
+		if !typ.TypeEqual(TypeFloat) {
+			t.Errorf("group %d: expected TypeFloat, got %s", i, typ.Type())
+		}
+	}
+}
+
 func TestTypeCheckSameTypedExprsError(t *testing.T) {
 	floatIntMismatchErr := `expected .* to be of type (float|int), found type (float|int)`
 	paramErr := `could not determine data type of parameter .*`